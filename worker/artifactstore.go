@@ -0,0 +1,207 @@
+package worker
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"cloud.google.com/go/storage"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	s3pkg "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"golang.org/x/xerrors"
+)
+
+// ArtifactStore persists job output somewhere uploadAndPostStatus
+// can hand a URL for, and fetches it back. Which implementation is
+// in play is decided once, at startup, by newArtifactStore; nothing
+// downstream needs to know or care.
+type ArtifactStore interface {
+	// Put uploads the contents of r under key and returns a URL
+	// that will later retrieve the same content.
+	Put(ctx context.Context, key string, r io.Reader) (string, error)
+
+	// Get retrieves whatever was last Put under key.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+}
+
+// newArtifactStore picks an ArtifactStore from cfg.ArtifactStore, a
+// URL of the form "s3://bucket", "gs://bucket", "azblob://container",
+// or "file:///served/dir". An empty ArtifactStore falls back to S3
+// with cfg.S3Bucket, matching every deployment predating this
+// abstraction.
+func newArtifactStore(cfg Config) (ArtifactStore, error) {
+	raw := cfg.ArtifactStore
+	if raw == "" {
+		raw = "s3://" + cfg.S3Bucket
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, xerrors.Errorf("parse ARTIFACT_STORE %q: %w", raw, err)
+	}
+
+	switch u.Scheme {
+	case "s3":
+		return newS3Store(cfg.S3Region, u.Host), nil
+	case "gs":
+		return newGCSStore(u.Host)
+	case "azblob":
+		return newAzureStore(u.Host)
+	case "file":
+		return newFileStore(u.Path, cfg.FileStoreURL), nil
+	default:
+		return nil, xerrors.Errorf("unknown ARTIFACT_STORE scheme %q", u.Scheme)
+	}
+}
+
+// s3Store is the original backend: every prior deployment of
+// testbot worker.
+type s3Store struct {
+	bucket string
+	svc    *s3pkg.S3
+}
+
+func newS3Store(region, bucket string) *s3Store {
+	svc := s3pkg.New(session.Must(session.NewSession(
+		aws.NewConfig().WithRegion(region),
+	)))
+	return &s3Store{bucket: bucket, svc: svc}
+}
+
+func (s *s3Store) Put(ctx context.Context, key string, r io.Reader) (string, error) {
+	uploader := s3manager.NewUploaderWithClient(s.svc)
+	out, err := uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Body:   r,
+	})
+	if err != nil {
+		return "", err
+	}
+	return out.Location, nil
+}
+
+func (s *s3Store) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	out, err := s.svc.GetObjectWithContext(ctx, &s3pkg.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+// gcsStore uploads to a Google Cloud Storage bucket.
+type gcsStore struct {
+	bucket *storage.BucketHandle
+	name   string
+}
+
+func newGCSStore(bucket string) (*gcsStore, error) {
+	client, err := storage.NewClient(context.Background())
+	if err != nil {
+		return nil, xerrors.Errorf("gcs client: %w", err)
+	}
+	return &gcsStore{bucket: client.Bucket(bucket), name: bucket}, nil
+}
+
+func (s *gcsStore) Put(ctx context.Context, key string, r io.Reader) (string, error) {
+	w := s.bucket.Object(key).NewWriter(ctx)
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return "https://storage.googleapis.com/" + s.name + "/" + key, nil
+}
+
+func (s *gcsStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return s.bucket.Object(key).NewReader(ctx)
+}
+
+// azureStore uploads to an Azure Blob Storage container. It expects
+// AZURE_STORAGE_ACCOUNT and AZURE_STORAGE_KEY in the environment,
+// the way the Azure SDK's shared-key credential helpers do.
+type azureStore struct {
+	container azblob.ContainerURL
+	name      string
+}
+
+func newAzureStore(container string) (*azureStore, error) {
+	account := os.Getenv("AZURE_STORAGE_ACCOUNT")
+	key := os.Getenv("AZURE_STORAGE_KEY")
+	cred, err := azblob.NewSharedKeyCredential(account, key)
+	if err != nil {
+		return nil, xerrors.Errorf("azure credential: %w", err)
+	}
+	pipeline := azblob.NewPipeline(cred, azblob.PipelineOptions{})
+	u, err := url.Parse("https://" + account + ".blob.core.windows.net/" + container)
+	if err != nil {
+		return nil, err
+	}
+	return &azureStore{container: azblob.NewContainerURL(*u, pipeline), name: container}, nil
+}
+
+func (s *azureStore) Put(ctx context.Context, key string, r io.Reader) (string, error) {
+	blob := s.container.NewBlockBlobURL(key)
+	_, err := azblob.UploadStreamToBlockBlob(ctx, r, blob, azblob.UploadStreamToBlockBlobOptions{})
+	if err != nil {
+		return "", err
+	}
+	return blob.URL().String(), nil
+}
+
+func (s *azureStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	blob := s.container.NewBlockBlobURL(key)
+	resp, err := blob.Download(ctx, 0, azblob.CountToEnd, azblob.BlobAccessConditions{}, false, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body(azblob.RetryReaderOptions{}), nil
+}
+
+// fileStore writes artifacts under a directory served over HTTP by
+// the farmer host, for deployments with no cloud object store at
+// all. baseURL is prefixed onto a key to build the URL it returns
+// from Put.
+type fileStore struct {
+	dir     string
+	baseURL string
+}
+
+func newFileStore(dir, baseURL string) *fileStore {
+	return &fileStore{dir: dir, baseURL: baseURL}
+}
+
+func (s *fileStore) Put(ctx context.Context, key string, r io.Reader) (string, error) {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return "", err
+	}
+	dst := filepath.Join(s.dir, key)
+	f, err := os.Create(dst)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return "", err
+	}
+	return s.baseURL + "/" + key, nil
+}
+
+func (s *fileStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(s.dir, key))
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
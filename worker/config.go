@@ -0,0 +1,51 @@
+package worker
+
+import "os"
+
+// Config is the worker's runtime configuration: where to store job
+// output, what git credentials to use, and the handful of other
+// settings that used to be package-level vars set once at init time
+// (and, on a -tags aws build, silently overwritten later with values
+// pulled from Parameter Store). LoadConfig gathers all of it in one
+// place, once, at startup.
+type Config struct {
+	S3Region       string
+	S3Bucket       string
+	NetlifyToken   string
+	GitCredentials string
+
+	// ArtifactStore selects where job output is uploaded: a URL
+	// like "s3://my-bucket", "gs://my-bucket", "azblob://my-container",
+	// or "file:///srv/artifacts". Empty defaults to S3Bucket for
+	// backwards compatibility with existing deployments.
+	ArtifactStore string
+
+	// FileStoreURL is the base URL the farmer serves a FileStore's
+	// directory under (only meaningful when ArtifactStore is a
+	// file:// URL).
+	FileStoreURL string
+}
+
+// paramStoreLoader, if registered, overlays values pulled from a
+// parameter store on top of the environment-derived Config. Exactly
+// one build (see config_paramstore.go, built with -tags aws)
+// registers it; no other backend needs its own build tag to get its
+// settings from somewhere other than the environment.
+var paramStoreLoader func(Config) (Config, error)
+
+// LoadConfig builds a Config from the environment, then lets
+// paramStoreLoader, if registered, fill in anything it knows better.
+func LoadConfig() (Config, error) {
+	cfg := Config{
+		S3Region:       or(os.Getenv("S3_REGION"), "us-west-1"),
+		S3Bucket:       os.Getenv("S3_BUCKET"),
+		NetlifyToken:   os.Getenv("NETLIFY_AUTH_TOKEN"),
+		GitCredentials: os.Getenv("GIT_CREDENTIALS"),
+		ArtifactStore:  os.Getenv("ARTIFACT_STORE"),
+		FileStoreURL:   os.Getenv("FILE_STORE_URL"),
+	}
+	if paramStoreLoader != nil {
+		return paramStoreLoader(cfg)
+	}
+	return cfg, nil
+}
@@ -0,0 +1,38 @@
+//go:build aws
+
+package worker
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+func init() {
+	paramStoreLoader = loadFromParameterStore
+}
+
+// loadFromParameterStore overlays cfg with values pulled from AWS
+// Systems Manager Parameter Store, the way regionS3/bucket/netlify/
+// gitCredentials used to be silently overwritten at init time on
+// -tags aws builds.
+func loadFromParameterStore(cfg Config) (Config, error) {
+	svc := ssm.New(session.Must(session.NewSession()))
+
+	get := func(name, fallback string) string {
+		out, err := svc.GetParameter(&ssm.GetParameterInput{
+			Name:           aws.String(name),
+			WithDecryption: aws.Bool(true),
+		})
+		if err != nil || out.Parameter == nil {
+			return fallback
+		}
+		return aws.StringValue(out.Parameter.Value)
+	}
+
+	cfg.S3Region = get("/testbot/worker/s3_region", cfg.S3Region)
+	cfg.S3Bucket = get("/testbot/worker/s3_bucket", cfg.S3Bucket)
+	cfg.NetlifyToken = get("/testbot/worker/netlify_token", cfg.NetlifyToken)
+	cfg.GitCredentials = get("/testbot/worker/git_credentials", cfg.GitCredentials)
+	return cfg, nil
+}
@@ -0,0 +1,351 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"golang.org/x/xerrors"
+
+	"github.com/wepogo/testbot/trace"
+)
+
+// dockerDefaultImage is used by DockerExec and KubernetesExec when a
+// Testfile doesn't specify an `image:` entry.
+const dockerDefaultImage = "golang:1.22"
+
+// Executor runs a job's test command in some execution environment:
+// the local host, a Docker container, a Kubernetes pod. The worker
+// picks a fresh one for each stage it runs (see selectExecutor and
+// runStage), so a single box can mix jobs that want isolation with
+// ones that don't.
+//
+// The usual call sequence is Prepare, Run, then, once the JobProc
+// returned by Run has finished, Collect and Cleanup.
+type Executor interface {
+	// Prepare readies dir for running a command: building an
+	// image, creating a scratch volume, whatever the backend
+	// needs. It runs once on each Executor, before Run.
+	Prepare(ctx context.Context, dir string, w io.Writer) error
+
+	// Run starts cmd in the environment set up by Prepare and
+	// returns a handle for waiting on and killing it. Run must
+	// not block until the command finishes.
+	Run(ctx context.Context, dir string, w io.Writer, cmd string, env []string) (JobProc, error)
+
+	// Env builds the environment a command passed to Run should
+	// get: the usual CHAIN/I10R/GOBIN/PATH variables, but pointed at
+	// wherever jobDir is actually reachable from inside this
+	// backend's sandbox rather than its real host path. LocalExec
+	// runs directly on the host, so its jobDir path already is the
+	// right one; Docker and Kubernetes only ever see jobDir's
+	// contents (if at all) through a mount at a fixed in-container
+	// path, so they remap accordingly.
+	Env(ctx context.Context, jobDir string) []string
+
+	// Collect writes to w any job output the backend kept
+	// somewhere other than the stream passed to Run (e.g. a pod's
+	// logs once it has gone away). Backends that stream straight
+	// to w in Run can make this a no-op.
+	Collect(ctx context.Context, w io.Writer) error
+
+	// Cleanup releases whatever Prepare and Run allocated
+	// (containers, pods, volumes). It must run even when the job
+	// was canceled, so it takes no ctx tied to the job's lifetime.
+	Cleanup() error
+}
+
+// JobProc is a running job, local or remote.
+type JobProc interface {
+	// Wait blocks until the job finishes and reports its result,
+	// the way exec.Cmd.Wait does.
+	Wait() error
+
+	// Kill terminates the job immediately, including any
+	// descendants. It's safe to call after Wait has returned, to
+	// mop up stragglers.
+	Kill() error
+}
+
+// selectExecutor picks a backend for a job based on the Testfile's
+// `backend:` entry (falling back to local execution). Valid values
+// are "local" (the default), "docker", and "kubernetes" (or "k8s").
+func selectExecutor(entries map[string]string) Executor {
+	image := entries["image"]
+	switch entries["backend"] {
+	case "docker":
+		return &DockerExec{Image: image}
+	case "kubernetes", "k8s":
+		return &KubernetesExec{Image: image}
+	default:
+		return LocalExec{}
+	}
+}
+
+// LocalExec runs a job's command directly on the worker host, the
+// way testbot has always done it. It provides no isolation between
+// jobs beyond their working directory.
+type LocalExec struct{}
+
+func (LocalExec) Prepare(ctx context.Context, dir string, w io.Writer) error { return nil }
+
+func (LocalExec) Env(ctx context.Context, jobDir string) []string { return commandEnv(ctx, jobDir) }
+
+func (LocalExec) Run(ctx context.Context, dir string, w io.Writer, cmd string, env []string) (JobProc, error) {
+	c := command(ctx, w, "/bin/bash", "-eo", "pipefail", "-c", cmd)
+	c.Env = env
+	c.Dir = dir
+	logCmd(c)
+	if err := c.Start(); err != nil {
+		return nil, err
+	}
+	return &localProc{cmd: c}, nil
+}
+
+func (LocalExec) Collect(ctx context.Context, w io.Writer) error { return nil }
+
+func (LocalExec) Cleanup() error { return nil }
+
+// localProc wraps an *exec.Cmd of a process group leader, so Kill
+// can take out the whole group rather than just the leader.
+type localProc struct {
+	cmd *exec.Cmd
+}
+
+func (p *localProc) Wait() error { return p.cmd.Wait() }
+
+func (p *localProc) Kill() error {
+	if p.cmd.Process == nil {
+		return nil
+	}
+	return syscall.Kill(-p.cmd.Process.Pid, syscall.SIGKILL)
+}
+
+// sandboxEnv is commandEnv's equivalent for a backend that doesn't
+// run on the host: repoDir and binDir are the in-container paths
+// CHAIN/I10R and GOBIN/PATH should point at instead of jobDir's real
+// host path, which the sandbox generally can't see (or can only see
+// read-only).
+func sandboxEnv(ctx context.Context, repoDir, binDir string) []string {
+	env := append(os.Environ(),
+		"CHAIN="+repoDir,
+		"I10R="+repoDir,
+		"GOBIN="+binDir,
+		"NETLIFY_AUTH_TOKEN="+cfg.NetlifyToken,
+		"PATH="+binDir+":"+repoDir+"/bin:"+os.Getenv("PATH"),
+	)
+	return append(env, trace.EnvironmentFor(ctx)...)
+}
+
+// DockerExec runs a job's command inside a per-job Docker
+// container. The checkout (dir, as passed to Run) is bind-mounted
+// read-only at /repo and a scratch volume is mounted at /scratch for
+// build output, so the job can't touch the worker's filesystem or
+// any other job's state.
+type DockerExec struct {
+	Image string // defaults to dockerDefaultImage if empty
+
+	name   string
+	volume string
+}
+
+func (e *DockerExec) Prepare(ctx context.Context, dir string, w io.Writer) error {
+	e.name = "testbot-" + randID()
+	e.volume = e.name + "-scratch"
+	return command(ctx, w, "docker", "volume", "create", e.volume).Run()
+}
+
+func (e *DockerExec) Run(ctx context.Context, dir string, w io.Writer, cmd string, env []string) (JobProc, error) {
+	args := []string{
+		"run", "--name", e.name,
+		"-v", dir + ":/repo:ro",
+		"-v", e.volume + ":/scratch",
+		"-w", "/repo",
+	}
+	for _, kv := range env {
+		args = append(args, "-e", kv)
+	}
+	args = append(args, or(e.Image, dockerDefaultImage), "/bin/bash", "-eo", "pipefail", "-c", cmd)
+
+	c := command(ctx, w, "docker", args...)
+	logCmd(c)
+	if err := c.Start(); err != nil {
+		return nil, err
+	}
+	return &localProc{cmd: c}, nil
+}
+
+// Env points CHAIN/I10R at /repo (the read-only mount Run sets up)
+// and GOBIN/PATH at /scratch (the writable scratch volume), since
+// /repo:ro can't take `go install` output the way a host checkout's
+// own bin/ can.
+func (e *DockerExec) Env(ctx context.Context, jobDir string) []string {
+	return sandboxEnv(ctx, "/repo", "/scratch/bin")
+}
+
+func (e *DockerExec) Collect(ctx context.Context, w io.Writer) error { return nil }
+
+func (e *DockerExec) Cleanup() error {
+	// Use a fresh, uncanceled context: cleanup must run even when
+	// the job that allocated these resources was killed.
+	ctx := context.Background()
+	command(ctx, ioutil.Discard, "docker", "rm", "-f", e.name).Run()
+	return command(ctx, ioutil.Discard, "docker", "volume", "rm", e.volume).Run()
+}
+
+// KubernetesExec runs a job's command as a Pod, for deployments that
+// would rather lean on a cluster scheduler than hand-managed EC2
+// boxes. It shells out to kubectl instead of importing a client
+// library, so it needs nothing beyond what's already on the box for
+// git and Docker.
+//
+// Unlike DockerExec, it doesn't mount the checkout (or anything
+// else) into the pod yet, so a command that needs files from dir
+// beyond what its image already bakes in won't find them; getting a
+// job's worktree into a pod is tracked separately. Env still targets
+// the same /repo, /scratch convention DockerExec uses, so a Testfile
+// doesn't see different variables depending on which backend happens
+// to run it.
+type KubernetesExec struct {
+	Namespace string // defaults to "testbot"
+	Image     string // defaults to dockerDefaultImage
+
+	pod string
+	ns  string
+}
+
+func (e *KubernetesExec) Prepare(ctx context.Context, dir string, w io.Writer) error {
+	e.pod = "testbot-" + randID()
+	e.ns = or(e.Namespace, "testbot")
+	return nil
+}
+
+func (e *KubernetesExec) Run(ctx context.Context, dir string, w io.Writer, cmd string, env []string) (JobProc, error) {
+	manifest := kubePodManifest(e.pod, e.ns, or(e.Image, dockerDefaultImage), cmd, env)
+
+	apply := command(ctx, w, "kubectl", "apply", "-f", "-")
+	apply.Stdin = strings.NewReader(manifest)
+	if err := apply.Run(); err != nil {
+		return nil, xerrors.Errorf("apply pod %s: %w", e.pod, err)
+	}
+
+	logs := command(ctx, w, "kubectl", "-n", e.ns, "logs", "-f", e.pod)
+	if err := logs.Start(); err != nil {
+		return nil, xerrors.Errorf("stream logs for pod %s: %w", e.pod, err)
+	}
+	return &kubeProc{ns: e.ns, pod: e.pod, logs: logs}, nil
+}
+
+func (e *KubernetesExec) Env(ctx context.Context, jobDir string) []string {
+	return sandboxEnv(ctx, "/repo", "/scratch/bin")
+}
+
+func (e *KubernetesExec) Collect(ctx context.Context, w io.Writer) error {
+	return command(ctx, w, "kubectl", "-n", e.ns, "logs", "--previous", e.pod).Run()
+}
+
+func (e *KubernetesExec) Cleanup() error {
+	ctx := context.Background()
+	return command(ctx, ioutil.Discard, "kubectl", "-n", e.ns, "delete", "pod", e.pod, "--ignore-not-found").Run()
+}
+
+// kubeProc tracks a Pod submitted by KubernetesExec.
+type kubeProc struct {
+	ns, pod string
+	logs    *exec.Cmd
+}
+
+func (p *kubeProc) Wait() error {
+	p.logs.Wait() // best-effort; the pod's phase is authoritative
+
+	out, err := exec.Command("kubectl", "-n", p.ns, "get", "pod", p.pod, "-o", "jsonpath={.status.phase}").Output()
+	if err != nil {
+		return xerrors.Errorf("get pod %s phase: %w", p.pod, err)
+	}
+	switch phase := string(out); phase {
+	case "Succeeded":
+		return nil
+	case "":
+		return xerrors.New("pod vanished before completing")
+	default:
+		return xerrors.Errorf("pod %s: %s", p.pod, phase)
+	}
+}
+
+func (p *kubeProc) Kill() error {
+	return exec.Command("kubectl", "-n", p.ns, "delete", "pod", p.pod, "--grace-period=0", "--force", "--ignore-not-found").Run()
+}
+
+// kubePodManifest renders a minimal Pod spec running cmd under bash,
+// with env set on the single container.
+func kubePodManifest(name, ns, image, cmd string, env []string) string {
+	var b strings.Builder
+	b.WriteString("apiVersion: v1\n")
+	b.WriteString("kind: Pod\n")
+	b.WriteString("metadata:\n")
+	b.WriteString("  name: " + name + "\n")
+	b.WriteString("  namespace: " + ns + "\n")
+	b.WriteString("spec:\n")
+	b.WriteString("  restartPolicy: Never\n")
+	b.WriteString("  containers:\n")
+	b.WriteString("  - name: job\n")
+	b.WriteString("    image: " + image + "\n")
+	b.WriteString("    command: [\"/bin/bash\", \"-eo\", \"pipefail\", \"-c\", " + quoteYAML(cmd) + "]\n")
+	if len(env) > 0 {
+		b.WriteString("    env:\n")
+		for _, kv := range env {
+			name, value := splitEnv(kv)
+			b.WriteString("    - {name: " + quoteYAML(name) + ", value: " + quoteYAML(value) + "}\n")
+		}
+	}
+	return b.String()
+}
+
+// quoteYAML renders s as a YAML double-quoted flow scalar. A
+// Testfile command is almost always multi-line, and a literal
+// newline inside an unescaped double-quoted scalar gets folded into
+// a space by the YAML spec, silently mangling the command kubectl
+// ends up running; \t and other control characters have the same
+// problem. So every ASCII control character (below 0x20, plus DEL)
+// and the two characters double-quoted scalars always need escaped,
+// \ and ", go through a \n/\t/\xXX-style escape instead of passing
+// through raw. Everything else, non-ASCII characters included, is
+// written unchanged.
+func quoteYAML(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '\\':
+			b.WriteString(`\\`)
+		case '"':
+			b.WriteString(`\"`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\r':
+			b.WriteString(`\r`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(&b, `\x%02x`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func splitEnv(kv string) (name, value string) {
+	if i := strings.IndexByte(kv, '='); i >= 0 {
+		return kv[:i], kv[i+1:]
+	}
+	return kv, ""
+}
@@ -0,0 +1,123 @@
+package worker
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+// LiveLog is the on-disk output buffer for the job currently
+// running on this box. It supports any number of concurrent readers
+// (e.g. several users watching the same job in the farmer UI) via
+// NewReader, each of which sees every byte written so far and then
+// blocks for more until the log is Close'd, at which point it gets
+// a clean io.EOF. This replaces the old single-reader follower,
+// which only worked for one in-flight /box-livesend request at a
+// time.
+type LiveLog struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	f      *os.File
+	size   int64
+	closed bool
+}
+
+// NewLiveLog creates the buffer file at path and returns a LiveLog
+// that writes to it.
+func NewLiveLog(path string) (*LiveLog, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	ll := &LiveLog{f: f}
+	ll.cond = sync.NewCond(&ll.mu)
+	return ll, nil
+}
+
+// Write appends p to the log and wakes any readers waiting for more
+// data. It implements io.Writer, so a LiveLog can be passed anywhere
+// a job's output writer is expected.
+func (ll *LiveLog) Write(p []byte) (int, error) {
+	ll.mu.Lock()
+	n, err := ll.f.Write(p)
+	ll.size += int64(n)
+	ll.mu.Unlock()
+
+	ll.cond.Broadcast()
+	return n, err
+}
+
+// File returns the underlying file, positioned wherever the last
+// write left it. Call this only once the log is done being written
+// to (e.g. to scan it for an error or upload it), not from a
+// concurrent reader.
+func (ll *LiveLog) File() *os.File {
+	return ll.f
+}
+
+// Close marks the log done: existing readers get io.EOF once they've
+// drained whatever was already written, and NewReader starts
+// refusing new ones. It does not close the underlying file, since
+// File's caller may still need it.
+func (ll *LiveLog) Close() error {
+	ll.mu.Lock()
+	ll.closed = true
+	ll.mu.Unlock()
+
+	ll.cond.Broadcast()
+	return nil
+}
+
+// NewReader returns a reader over the log starting at byte 0. It
+// will block past the bytes written so far until more arrive or the
+// log is Close'd, at which point it returns io.EOF. Any number of
+// readers may be open at once. NewReader fails once the log has
+// already been closed.
+func (ll *LiveLog) NewReader() (io.ReadCloser, error) {
+	ll.mu.Lock()
+	closed := ll.closed
+	name := ll.f.Name()
+	ll.mu.Unlock()
+
+	if closed {
+		return nil, xerrors.New("livelog: already closed")
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &liveLogReader{ll: ll, f: f}, nil
+}
+
+type liveLogReader struct {
+	ll *LiveLog
+	f  *os.File
+}
+
+func (r *liveLogReader) Read(p []byte) (int, error) {
+	r.ll.mu.Lock()
+	for {
+		pos, err := r.f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			r.ll.mu.Unlock()
+			return 0, err
+		}
+		if pos < r.ll.size {
+			break // there's unread data waiting
+		}
+		if r.ll.closed {
+			r.ll.mu.Unlock()
+			return 0, io.EOF
+		}
+		r.ll.cond.Wait()
+	}
+	r.ll.mu.Unlock()
+
+	return r.f.Read(p)
+}
+
+func (r *liveLogReader) Close() error {
+	return r.f.Close()
+}
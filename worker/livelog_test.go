@@ -0,0 +1,76 @@
+package worker
+
+import (
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLiveLogReaderSeesWritesBeforeClose(t *testing.T) {
+	ll, err := NewLiveLog(filepath.Join(t.TempDir(), "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ll.Write([]byte("first\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := ll.NewReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// The reader should see "first\n" without blocking.
+	buf := make([]byte, len("first\n"))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatalf("reading data written before NewReader: %v", err)
+	}
+	if string(buf) != "first\n" {
+		t.Fatalf("got %q, want %q", buf, "first\n")
+	}
+
+	// A second write, after the reader is already blocked past the
+	// end of the file, should wake it rather than leave it stuck.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		rest, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Error(err)
+		}
+		if string(rest) != "second\n" {
+			t.Errorf("got %q, want %q", rest, "second\n")
+		}
+	}()
+
+	time.Sleep(20 * time.Millisecond) // give the reader time to block on cond.Wait
+	if _, err := ll.Write([]byte("second\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ll.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("reader never woke up after Write + Close")
+	}
+}
+
+func TestLiveLogNewReaderAfterClose(t *testing.T) {
+	ll, err := NewLiveLog(filepath.Join(t.TempDir(), "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ll.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ll.NewReader(); err == nil {
+		t.Fatal("NewReader after Close: got nil error, want one")
+	}
+}
@@ -15,6 +15,10 @@ The `testbot worker` command runs on EC2. It:
 * runs the commands in the job directory's `Testfile`
 * reports results back to the `testbot farmer` service
 
+The job's test command itself runs through an Executor (see
+executor.go), which is how a Testfile opts into running under Docker
+or Kubernetes instead of directly on the worker host.
+
 */
 
 import (
@@ -33,15 +37,13 @@ import (
 	"os/user"
 	"path"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	s3pkg "github.com/aws/aws-sdk-go/service/s3"
 	"golang.org/x/xerrors"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
 
@@ -54,6 +56,14 @@ import (
 // so this is about as tight as we can make it right now.
 const jobTimeout = 3 * time.Minute
 
+// Worktrees idle for longer than gcMaxAge are assumed abandoned
+// (e.g. the box crashed mid-job) and pruned by repoCache's GC, which
+// runs every gcInterval.
+const (
+	gcInterval = 10 * time.Minute
+	gcMaxAge   = 30 * time.Minute
+)
+
 func or(v, d string) string {
 	if v == "" {
 		v = d
@@ -83,38 +93,44 @@ var (
 			ExpectContinueTimeout: 1 * time.Second,
 		}}
 
-	// If compiled with -tags aws, regionS3, bucket, netlify
-	// and gitCredentials will be overwritten with the value
-	// from Parameter Store.
-	regionS3       = "us-west-1"
-	gitCredentials = os.Getenv("GIT_CREDENTIALS")
-	bucket         = os.Getenv("S3_BUCKET")
-	netlify        = os.Getenv("NETLIFY_AUTH_TOKEN")
-
-	// Directory layout
-	rootDir = path.Join(os.Getenv("HOME"), "worker")
-	binDir  = path.Join(os.Getenv("HOME"), "bin")
-	outDir  = path.Join(rootDir, "out")
-	wsDir   = path.Join(rootDir, "ws")
-	repoDir = path.Join(wsDir, "src/"+or(os.Getenv("DIRNAME"), repo))
+	// cfg is set up once in Main/OneJob by LoadConfig, and
+	// artifactStore once in Main by newArtifactStore; see config.go
+	// and artifactstore.go. OneJob uploads nothing, so it leaves
+	// artifactStore nil.
+	cfg           Config
+	artifactStore ArtifactStore
+
+	// Directory layout. Each job gets its own worktree under wsDir
+	// (see RepoCache) and its own GOBIN under that worktree, so
+	// concurrent jobs no longer share a checkout or a $GOBIN.
+	rootDir  = path.Join(os.Getenv("HOME"), "worker")
+	outDir   = path.Join(rootDir, "out")
+	wsDir    = path.Join(rootDir, "ws")
+	cacheDir = path.Join(rootDir, "cache")
+
+	repoCache *RepoCache
 
 	pingReq = testbot.BoxPingReq{
 		ID:   boxID,
 		Host: hostname,
 	}
 
-	s3 *s3pkg.S3
-
-	curMu  sync.Mutex
-	curOut string
-	curJob testbot.Job
+	// curJobs tracks every job currently running on this box (one
+	// per available CPU slot; see jobSlots), so /box-livesend can
+	// find the right LiveLog no matter how many jobs are in flight.
+	curMu   sync.Mutex
+	curJobs = map[testbot.Job]*LiveLog{}
 )
 
 // Main registers box with farmer, waits for jobs
 func Main() {
 	fmt.Println("starting box", boxID)
 
-	if gitCredentials != "" {
+	var err error
+	cfg, err = LoadConfig()
+	must(err)
+
+	if cfg.GitCredentials != "" {
 		usr, err := user.Current()
 		if err != nil {
 			log.Fatalkv(context.Background(), log.Error, err, "at", "getting current user")
@@ -122,7 +138,7 @@ func Main() {
 		gitfile := usr.HomeDir + "/.git-credentials"
 
 		// write credentials to ~/.git-credentials
-		must(ioutil.WriteFile(gitfile, []byte(gitCredentials+"\n"), 0700))
+		must(ioutil.WriteFile(gitfile, []byte(cfg.GitCredentials+"\n"), 0700))
 
 		// update ~/.gitconfig to be configured to use ~/.git-credentials
 		must(
@@ -140,9 +156,8 @@ func Main() {
 
 	tracer.Start(tracer.WithSampler(tracer.NewAllSampler()))
 
-	s3 = s3pkg.New(session.Must(session.NewSession(
-		aws.NewConfig().WithRegion(regionS3),
-	)))
+	artifactStore, err = newArtifactStore(cfg)
+	must(err)
 
 	initFilesystem()
 
@@ -154,7 +169,25 @@ func Main() {
 		}
 	}()
 	go pollForOutput()
+	go repoCache.GC(context.Background(), gcInterval, gcMaxAge)
+
+	var wg sync.WaitGroup
+	for i := 0; i < jobSlots(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runJobs()
+		}()
+	}
+	wg.Wait()
+}
 
+// runJobs claims one job at a time from the farmer and runs it until
+// it finishes or the farmer hands this loop a new job, which cancels
+// it (see startJob's jobCancel). Main runs jobSlots of these concurrently, each with
+// its own worktree (via repoCache) so they don't step on each
+// other.
+func runJobs() {
 	state := testbot.BoxState{ID: boxID}
 	cancel := func() {}
 	for {
@@ -164,20 +197,35 @@ func Main() {
 	}
 }
 
+// jobSlots is how many jobs this box runs at once: one per CPU,
+// since each job can burn a full core compiling or testing.
+func jobSlots() int {
+	if n := runtime.NumCPU(); n > 0 {
+		return n
+	}
+	return 1
+}
+
 // OneJob is like main, but runs a single job
 // without registering with the farmer.
 // It writes output to stdout instead of S3.
 // It requires all the same environment as Main.
 func OneJob(job testbot.Job) {
+	var err error
+	cfg, err = LoadConfig()
+	must(err)
+
 	initFilesystem()
 	ctx := context.Background()
-	cmd, _, err := startJobProc(ctx, os.Stdout, job)
+	sj, err := startJobProc(ctx, os.Stdout, job)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, job, err)
 		os.Exit(2)
 	}
-	err = cmd.Wait()
-	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) // kill entire process group
+	defer sj.cancel()
+	err = sj.proc.Wait()
+	sj.proc.Kill() // mop up anything the job left running
+	sj.executor.Cleanup()
 	if err != nil {
 		fmt.Fprintln(os.Stderr, job, err)
 		os.Exit(2)
@@ -213,15 +261,6 @@ func pollForOutput() {
 			continue
 		}
 		go sendOutput(job)
-
-		// Give our sendOutput RPC a chance to consume
-		// the request for job output before we poll again.
-		// If we poll immediately, we are more likely
-		// to pick up the same request again.
-		// It's not so bad if that happens sometimes
-		// (all but one sendOutput body will be dropped),
-		// it's just a little wasteful. So avoid it.
-		time.Sleep(50 * time.Millisecond)
 	}
 }
 
@@ -230,8 +269,10 @@ func initFilesystem() {
 	must(os.RemoveAll(rootDir))
 	must(os.MkdirAll(wsDir, 0700))
 	must(os.MkdirAll(outDir, 0700))
-	must(command(ctx, os.Stdout, "git", "clone", repoURL, repoDir).Run())
-	must(runIn(ctx, repoDir, command(ctx, os.Stdout, "git", "checkout", "-bt")))
+
+	var err error
+	repoCache, err = NewRepoCache(ctx, os.Stdout, cacheDir, wsDir, repoURL)
+	must(err)
 }
 
 func waitState(oldState testbot.BoxState) (newState testbot.BoxState) {
@@ -267,6 +308,13 @@ func startJob(job testbot.Job) func() {
 
 	jobCtx := context.Background()
 	jobCtx = tracer.ContextWithSpan(jobCtx, span)
+	// jobCtx carries no deadline of its own: startJobProc bounds the
+	// worktree clone with the bare jobTimeout, then lets each stage
+	// (setup/pre/test) establish its own timeout from the Testfile, so
+	// a timeout.test: override isn't clipped by an outer deadline set
+	// before the Testfile was even read. jobCancel is purely for
+	// displacing a job when the next one comes in (see runJobs).
+	jobCtx, jobCancel := context.WithCancel(jobCtx)
 
 	postStatus := func(status, desc, url string) {
 		req := testbot.BoxJobUpdateReq{
@@ -285,7 +333,7 @@ func startJob(job testbot.Job) func() {
 
 	postStatus("pending", "running", "")
 
-	f, err := os.Create(path.Join(outDir, outputFile(job)))
+	ll, err := NewLiveLog(path.Join(outDir, outputFile(job)))
 	if err != nil {
 		fmt.Fprintln(os.Stderr, job, err)
 		postStatus("error", err.Error(), "")
@@ -293,59 +341,96 @@ func startJob(job testbot.Job) func() {
 	}
 
 	curMu.Lock()
-	curOut = f.Name()
-	curJob = job
+	curJobs[job] = ll
 	curMu.Unlock()
 
-	cmddir := filepath.Join(repoDir, filepath.FromSlash(job.Dir))
+	// jobDir and cmddir are filled in below once startJobProc has
+	// materialized the job's worktree; uploadAndPostStatus only
+	// runs afterward, so it sees the final values.
+	var jobDir, cmddir string
 
-	// must be called exactly once (to close f)
+	// must be called exactly once (to close ll)
 	uploadAndPostStatus := func(status, desc string) {
 		defer func() {
 			curMu.Lock()
-			curJob = testbot.Job{}
-			curOut = ""
+			delete(curJobs, job)
 			curMu.Unlock()
 		}()
+		defer ll.Close()
+
+		f := ll.File()
 		defer f.Close()
 
-		fmt.Fprintln(f, desc)
+		// Through ll.Write, not fmt.Fprintln(f, ...): writing to f
+		// directly would bypass the size/Broadcast bookkeeping that
+		// lets a concurrent NewReader see this line before Close
+		// sends it io.EOF.
+		fmt.Fprintln(ll, desc)
 		f.Seek(0, 0)
 		if s := scanError(f); s != "" && status != "success" {
 			s = strings.Replace(s, cmddir+"/", "", -1)
-			s = strings.Replace(s, repoDir+"/", "$I10R/", -1)
+			s = strings.Replace(s, jobDir+"/", "$I10R/", -1)
 			desc += ": " + s
 		}
 		f.Seek(0, 0)
-		u, err := uploadToS3(f)
+		u, err := artifactStore.Put(context.Background(), filepath.Base(f.Name()), f)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, job, "cannot upload output file", err)
-			postStatus("error", "S3 upload: "+err.Error(), "")
+			postStatus("error", "artifact upload: "+err.Error(), "")
 			return
 		}
 		postStatus(status, desc, u)
 	}
 
-	jobCtx, cancel := context.WithTimeout(jobCtx, jobTimeout)
-	cmd, cmdSpan, err := startJobProc(jobCtx, f, job)
+	sj, err := startJobProc(jobCtx, ll, job)
 	if err != nil {
-		cancel()
+		jobCancel()
 		fmt.Fprintln(os.Stderr, job, err)
 		uploadAndPostStatus("error", err.Error())
 		return func() {}
 	}
+	jobDir = sj.jobDir
+	cmddir = filepath.Join(jobDir, filepath.FromSlash(job.Dir))
+	entries := sj.entries
 
 	// wait for job, post result status
 	done := make(chan int)
 	go func() {
 		defer close(done) // ok to start next job
+		defer sj.cancel()
+
+		jobErr := sj.proc.Wait()
+		sj.span.Finish()
+		sj.proc.Kill() // mop up anything the job left running
+		if err := sj.executor.Collect(context.Background(), ll); err != nil {
+			fmt.Fprintln(os.Stderr, job, "collect:", err)
+		}
+		if err := sj.executor.Cleanup(); err != nil {
+			fmt.Fprintln(os.Stderr, job, "cleanup:", err)
+		}
+
+		// post only runs after a clean success, same as a CI
+		// pipeline's post-success hook; teardown then always runs,
+		// even if the test stage failed or was canceled.
+		if jobErr == nil {
+			if post := entries[stagePost]; post != "" {
+				if err := runStage(context.Background(), cmddir, ll, entries, stagePost, post, jobDir, jobTimeout); err != nil {
+					jobErr = xerrors.Errorf("post: %w", err)
+				}
+			}
+		}
+		if td := entries[stageTeardown]; td != "" {
+			if err := runStage(context.Background(), cmddir, ll, entries, stageTeardown, td, jobDir, jobTimeout); err != nil {
+				fmt.Fprintln(os.Stderr, job, "teardown:", err)
+			}
+		}
 
-		jobErr := cmd.Wait()
-		cmdSpan.Finish()
-		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) // kill entire process group
+		if err := repoCache.Remove(context.Background(), os.Stderr, jobDir); err != nil {
+			fmt.Fprintln(os.Stderr, job, "worktree remove:", err)
+		}
 
-		if jobErr != nil && jobCtx.Err() != nil {
-			uploadAndPostStatus("error", fmt.Sprintf("canceled automatically: %s: %s", jobCtx.Err(), jobErr))
+		if jobErr != nil && sj.ctx.Err() != nil {
+			uploadAndPostStatus("error", fmt.Sprintf("canceled automatically: %s: %s", sj.ctx.Err(), jobErr))
 		} else if jobErr != nil {
 			fmt.Fprintln(os.Stderr, job, "failure running job", jobErr)
 			uploadAndPostStatus("failure", jobErr.Error())
@@ -356,123 +441,143 @@ func startJob(job testbot.Job) func() {
 		}
 	}()
 
-	return func() { cancel(); <-done }
+	return func() { jobCancel(); <-done }
 }
 
-func startJobProc(ctx context.Context, w io.Writer, job testbot.Job) (*exec.Cmd, tracer.Span, error) {
+// startedJob is what startJobProc hands back to startJob/OneJob once
+// the job's test stage is running: the process itself, plus
+// everything needed to finish watching it. ctx/cancel are the test
+// stage's own context, established only once its Testfile entry
+// (and any timeout.test: override) is known — not the bare jobTimeout
+// a caller might otherwise be tempted to impose up front.
+type startedJob struct {
+	proc     JobProc
+	span     tracer.Span
+	executor Executor
+	jobDir   string
+	entries  map[string]string
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// startJobProc materializes job's worktree, runs its setup and pre
+// stages, and starts its test stage running. ctx should carry no
+// deadline of its own: the worktree clone is the only phase bounded
+// by the bare jobTimeout constant here, since nothing has read the
+// Testfile yet to offer an override; every stage after that (setup,
+// pre, and finally test) establishes its own timeout from the
+// Testfile via stageTimeout, so e.g. timeout.test: can run well past
+// jobTimeout if the Testfile says so.
+func startJobProc(ctx context.Context, w io.Writer, job testbot.Job) (*startedJob, error) {
 	fmt.Fprintln(w, "starting job", job)
 	fmt.Fprintln(w, "worker host", hostname)
 
 	start := time.Now()
 	var setupBuf bytes.Buffer
-	err := setupJob(ctx, &setupBuf, job.SHA)
+	cloneCtx, cloneCancel := context.WithTimeout(ctx, jobTimeout)
+	jobDir, err := setupJob(cloneCtx, &setupBuf, job.SHA)
+	cloneCancel()
 	if err != nil {
 		w.Write(setupBuf.Bytes())
-		return nil, nil, xerrors.Errorf("clone: %w", err)
+		return nil, xerrors.Errorf("worktree: %w", err)
 	}
 	fmt.Fprintln(w, "setup ok", time.Since(start))
-	cmddir := path.Join(repoDir, job.Dir)
-
-	// Before we run actual tests, traverse the tree to find all `setup` tasks in all Testfiles
-	// and run these tasks first. This will guarantee, for example, that when a Go package depends
-	// on a Rust crate, that crate will be built before the tests or `go vet` would run.
-	//
-	// WARNING: We do not guarantee any particular order. If you have cross-directory
-	// dependencies you should configure your own Makefiles.
-
-	// Traverse all folders, open testfiles, read `setup` tasks and run them.
-	err = filepath.Walk(cmddir, func(fullPath string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if info.IsDir() {
-			return nil
-		}
-		if info.Name() != "Testfile" {
-			return nil
-		}
+	cmddir := path.Join(jobDir, job.Dir)
 
-		testfile, err := os.Open(fullPath)
-		if err != nil {
-			return err
-		}
-		defer testfile.Close()
-
-		entries, err := testbot.ParseTestfile(testfile)
-		if err != nil {
-			return err
-		}
-
-		// Note: the "setup" key has a special meaning and is therefore ignored by the tests.
-		cmd := entries["setup"]
-
-		if cmd == "" {
-			return nil
-		}
-
-		c := prepareCommand(ctx, filepath.Dir(fullPath), w, cmd)
-		return c.Run()
-	})
-
-	if err != nil {
-		return nil, nil, err
+	// Run every directory's "setup" stage first, in depends_on
+	// order, so that e.g. a Go package depending on a Rust crate
+	// sees the crate already built before `go test`/`go vet` runs.
+	if err := runSetupStages(ctx, cmddir, w, jobDir); err != nil {
+		return nil, err
 	}
 
 	// Run the actual tests:
 
 	testfile, err := os.Open(path.Join(cmddir, "Testfile"))
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 	defer testfile.Close()
 
 	entries, err := testbot.ParseTestfile(testfile)
 	if err != nil {
 		fmt.Fprintf(w, "parse %s: %v\n", testfile.Name(), err)
-		return nil, nil, err
+		return nil, err
 	}
 
 	cmd, ok := entries[job.Name]
 	if !ok {
 		fmt.Fprintln(w, "cannot find Testfile entry", job.Name)
-		return nil, nil, xerrors.Errorf("cannot find Testfile entry %s", job.Name)
+		return nil, xerrors.Errorf("cannot find Testfile entry %s", job.Name)
+	}
+
+	if pre := entries[stagePre]; pre != "" {
+		if err := runStage(ctx, cmddir, w, entries, stagePre, pre, jobDir, jobTimeout); err != nil {
+			return nil, xerrors.Errorf("pre: %w", err)
+		}
 	}
 
-	span, ctx := tracer.StartSpanFromContext(ctx, "runtest")
+	// Only now, with the Testfile in hand, can the test stage's own
+	// timeout.test: override (or jobTimeout, absent one) be applied.
+	// This ctx is what startJob later watches for cancellation/expiry;
+	// unlike setup/pre/post/teardown, test runs asynchronously, so
+	// startJob owns its Executor and this context directly rather than
+	// going through runStage.
+	testCtx, cancel := context.WithTimeout(ctx, stageTimeout(entries, stageTest, jobTimeout))
+
+	span, testCtx := tracer.StartSpanFromContext(testCtx, "runtest")
 	span.SetTag("cmd", cmd)
 	span.SetTag("dir", cmddir)
-	// no span.Finish() call here, that happens in startJob
+	span.SetTag("backend", entries["backend"])
+	// no span.Finish() call here, that happens in startJob.
 
-	c := prepareCommand(ctx, cmddir, w, cmd)
-	return c, span, c.Start()
+	executor := selectExecutor(entries)
+	if err := executor.Prepare(testCtx, cmddir, w); err != nil {
+		cancel()
+		return nil, xerrors.Errorf("prepare %s backend: %w", entries["backend"], err)
+	}
+
+	proc, err := executor.Run(testCtx, cmddir, w, cmd, stageEnv(entries, stageTest, executor.Env(testCtx, jobDir)))
+	if err != nil {
+		executor.Cleanup()
+		cancel()
+		return nil, err
+	}
+	return &startedJob{
+		proc:     proc,
+		span:     span,
+		executor: executor,
+		jobDir:   jobDir,
+		entries:  entries,
+		ctx:      testCtx,
+		cancel:   cancel,
+	}, nil
 }
 
-func prepareCommand(ctx context.Context, dir string, w io.Writer, cmd string) *exec.Cmd {
-	c := command(ctx, w, "/bin/bash", "-eo", "pipefail", "-c", cmd)
-	c.Env = append(os.Environ(),
-		"CHAIN="+repoDir,
-		"I10R="+repoDir,
+// commandEnv is the environment passed to a job's test command: the
+// worker's own environment plus the testbot-specific variables every
+// job gets, scoped to that job's own worktree and GOBIN.
+func commandEnv(ctx context.Context, jobDir string) []string {
+	binDir := path.Join(jobDir, "bin")
+	env := append(os.Environ(),
+		"CHAIN="+jobDir,
+		"I10R="+jobDir,
 		"GOBIN="+binDir,
-		"NETLIFY_AUTH_TOKEN="+netlify,
-		"PATH="+binDir+":"+repoDir+"/bin:"+os.Getenv("PATH"),
+		"NETLIFY_AUTH_TOKEN="+cfg.NetlifyToken,
+		"PATH="+binDir+":"+jobDir+"/bin:"+os.Getenv("PATH"),
 	)
-	c.Env = append(c.Env, trace.EnvironmentFor(ctx)...)
-	c.Dir = dir
-	fmt.Fprintln(w, "cd", c.Dir)
-	fmt.Fprintln(w, cmd)
-	return c
+	return append(env, trace.EnvironmentFor(ctx)...)
 }
 
 func sendOutput(j testbot.Job) {
 	ctx := context.Background()
-	f, err := getOutput(j)
+	r, err := getOutput(j)
 	if err != nil {
 		log.Error(ctx, err)
 		return
 	}
-	defer f.Close()
-	body := &follower{f: f}
-	req, err := http.NewRequest("POST", farmerURL+"/box-livesend", body)
+	defer r.Close()
+	req, err := http.NewRequest("POST", farmerURL+"/box-livesend", r)
 	if err != nil {
 		log.Error(ctx, err)
 		return
@@ -490,20 +595,15 @@ func sendOutput(j testbot.Job) {
 	resp.Body.Close()
 }
 
-func getOutput(j testbot.Job) (*os.File, error) {
+func getOutput(j testbot.Job) (io.ReadCloser, error) {
 	curMu.Lock()
-	if curJob != j {
-		curMu.Unlock()
-		return nil, xerrors.New("not found")
-	}
-	name := curOut
+	ll := curJobs[j]
 	curMu.Unlock()
 
-	f, err := os.Open(name)
-	if err != nil {
-		return nil, err
+	if ll == nil {
+		return nil, xerrors.New("not found")
 	}
-	return f, nil
+	return ll.NewReader()
 }
 
 func outputFile(job testbot.Job) string {
@@ -521,38 +621,15 @@ func must(err error) {
 	}
 }
 
-func setupJob(ctx context.Context, w io.Writer, sha string) error {
+// setupJob materializes a fresh, detached worktree for sha and
+// returns its path. Unlike the old clean+reset against a single
+// shared repoDir, this never blocks on (or clobbers) any other
+// job's checkout.
+func setupJob(ctx context.Context, w io.Writer, sha string) (string, error) {
 	span, ctx := tracer.StartSpanFromContext(ctx, "setup")
 	defer span.Finish()
 
-	// Make sure we have sha in the local clone.
-	if !objectExists(ctx, w, sha) {
-		err := runIn(ctx, repoDir, command(ctx, w, "git", "fetch"))
-		if err != nil {
-			// Sometimes this fails, and trying again usually works.
-			// So try again just one more time, after a brief wait.
-			// If it still fails after that, give up.
-			time.Sleep(2 * time.Second)
-			err = runIn(ctx, repoDir, command(ctx, w, "git", "fetch"))
-		}
-		if err != nil {
-			return err
-		}
-	}
-
-	err := runIn(ctx, repoDir, command(ctx, w, "git", "clean", "-xdf"))
-	if err != nil {
-		return err
-	}
-	return runIn(ctx, repoDir, command(ctx, w, "git", "reset", "--hard", sha))
-}
-
-// objectExists returns whether the object definitely exists.
-// It returns false if the object doesn't exist, or if there
-// was an error.
-func objectExists(ctx context.Context, w io.Writer, sha string) bool {
-	err := runIn(ctx, repoDir, command(ctx, w, "git", "cat-file", "-e", sha))
-	return err == nil
+	return repoCache.Worktree(ctx, w, randID(), sha)
 }
 
 func runIn(ctx context.Context, dir string, c *exec.Cmd) error {
@@ -627,41 +704,6 @@ func randID() string {
 	return hex.EncodeToString(b)
 }
 
-// A follower acts like 'tail -f'.
-// It reads from f to the end, then waits for more data
-// to be appended to f, and it reads that too.
-// It returns EOF when curOut and f are no longer
-// the same file (while f is at the end).
-type follower struct {
-	f *os.File
-	n int64
-}
-
-func (f *follower) Read(p []byte) (int, error) {
-	for {
-		running := isCur(f.f)
-		n, err := f.f.Read(p)
-		f.n += int64(n)
-		if err != nil && err != io.EOF {
-			return n, err
-		}
-		if n == 0 && err == io.EOF && !running {
-			return n, io.EOF
-		}
-		if n == 0 {
-			time.Sleep(100 * time.Millisecond)
-			continue // nothing happened, try again
-		}
-		return n, nil
-	}
-}
-
-func isCur(f *os.File) bool {
-	curMu.Lock()
-	defer curMu.Unlock()
-	return curOut == f.Name()
-}
-
 func traceURL(span tracer.Span) string {
 	const f = "https://app.datadoghq.com/apm/trace/%d?spanID=%d"
 	return fmt.Sprintf(f, span.Context().TraceID(), span.Context().SpanID())
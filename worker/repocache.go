@@ -0,0 +1,187 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// RepoCache keeps one bare mirror of the upstream repo on disk and
+// hands out disposable worktrees from it, so jobs no longer share
+// (and fight over) a single checkout. NewRepoCache sets it up once
+// at startup; each job then calls Worktree to get its own directory
+// and Remove to tear it down again.
+//
+// jobSlots runs several jobs' Worktree/Remove concurrently against
+// this one mirror, alongside GC's own fetch/gc, and `git` itself
+// isn't safe for that: concurrent fetch/worktree add/worktree
+// remove/worktree prune/gc all take the same .git/*.lock and fail
+// each other out from under unrelated jobs. mu serializes every
+// operation that touches the mirror so only one runs at a time;
+// per-job worktrees themselves still live in separate directories,
+// so jobs don't serialize on each other's actual test runs, only on
+// this bookkeeping.
+type RepoCache struct {
+	mirror string // <cacheDir>/<repo>.git, a `git clone --mirror`
+	wsDir  string // parent directory of every job's worktree
+
+	mu sync.Mutex
+
+	// activeMu guards active, the set of worktree directories
+	// currently in use by a job. gcOnce consults it before relying on
+	// a directory's mtime: a long setup/pre/post/teardown stage (see
+	// stages.go's timeout.<stage>: overrides) can run well past
+	// gcMaxAge without touching anything at the worktree's own
+	// top-level directory, which is all os.ReadDir's ModTime sees. A
+	// directory only ever gets reaped by mtime once it's no longer
+	// active, i.e. once it's orphaned (the box crashed mid-job) rather
+	// than merely slow.
+	activeMu sync.Mutex
+	active   map[string]bool
+}
+
+// NewRepoCache clones url as a bare mirror under cacheDir (reusing
+// it if it's already there) and returns a RepoCache that
+// materializes worktrees under wsDir.
+func NewRepoCache(ctx context.Context, w io.Writer, cacheDir, wsDir, url string) (*RepoCache, error) {
+	if err := os.MkdirAll(cacheDir, 0700); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(wsDir, 0700); err != nil {
+		return nil, err
+	}
+
+	mirror := filepath.Join(cacheDir, filepath.Base(url))
+	if _, err := os.Stat(mirror); os.IsNotExist(err) {
+		err := command(ctx, w, "git", "clone", "--mirror", url, mirror).Run()
+		if err != nil {
+			return nil, xerrors.Errorf("mirror clone: %w", err)
+		}
+	}
+	return &RepoCache{mirror: mirror, wsDir: wsDir, active: map[string]bool{}}, nil
+}
+
+// runLocked runs a git command against the mirror with mu held, so
+// it never overlaps another mirror-mutating git invocation.
+func (c *RepoCache) runLocked(ctx context.Context, w io.Writer, args ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return runIn(ctx, c.mirror, command(ctx, w, args[0], args[1:]...))
+}
+
+// fetch updates the mirror so a newly pushed sha becomes available
+// locally.
+func (c *RepoCache) fetch(ctx context.Context, w io.Writer) error {
+	err := c.runLocked(ctx, w, "git", "fetch")
+	if err != nil {
+		// Sometimes this fails, and trying again usually works.
+		// So try again just once more, after a brief wait. If it
+		// still fails after that, give up.
+		time.Sleep(2 * time.Second)
+		err = c.runLocked(ctx, w, "git", "fetch")
+	}
+	return err
+}
+
+// hasObject reports whether sha is present in the mirror already.
+func (c *RepoCache) hasObject(ctx context.Context, w io.Writer, sha string) bool {
+	return c.runLocked(ctx, w, "git", "cat-file", "-e", sha) == nil
+}
+
+// Worktree materializes a throwaway worktree checked out (detached)
+// at sha, named after jobID so it can't collide with any other
+// job's. The caller should Remove it once the job is done.
+func (c *RepoCache) Worktree(ctx context.Context, w io.Writer, jobID, sha string) (string, error) {
+	if !c.hasObject(ctx, w, sha) {
+		if err := c.fetch(ctx, w); err != nil {
+			return "", err
+		}
+	}
+
+	dir := filepath.Join(c.wsDir, jobID)
+	err := c.runLocked(ctx, w, "git", "worktree", "add", "--detach", dir, sha)
+	if err != nil {
+		return "", err
+	}
+	c.setActive(dir, true)
+	return dir, nil
+}
+
+// Remove tears down a worktree created by Worktree.
+func (c *RepoCache) Remove(ctx context.Context, w io.Writer, dir string) error {
+	defer c.setActive(dir, false)
+
+	err := c.runLocked(ctx, w, "git", "worktree", "remove", "--force", dir)
+	if err != nil {
+		return err
+	}
+	return c.runLocked(ctx, w, "git", "worktree", "prune")
+}
+
+func (c *RepoCache) setActive(dir string, active bool) {
+	c.activeMu.Lock()
+	defer c.activeMu.Unlock()
+	if active {
+		c.active[dir] = true
+	} else {
+		delete(c.active, dir)
+	}
+}
+
+func (c *RepoCache) isActive(dir string) bool {
+	c.activeMu.Lock()
+	defer c.activeMu.Unlock()
+	return c.active[dir]
+}
+
+// GC periodically removes orphaned worktrees (ones no job is
+// actively using, idle for longer than maxAge) and runs `git gc
+// --auto` on the mirror, so a long-lived box doesn't accumulate stale
+// checkouts or an ever-growing object store. It runs until ctx is
+// canceled.
+func (c *RepoCache) GC(ctx context.Context, interval, maxAge time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.gcOnce(ctx, maxAge)
+		}
+	}
+}
+
+func (c *RepoCache) gcOnce(ctx context.Context, maxAge time.Duration) {
+	entries, err := os.ReadDir(c.wsDir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "repo cache gc: readdir:", err)
+		return
+	}
+	for _, e := range entries {
+		dir := filepath.Join(c.wsDir, e.Name())
+		if c.isActive(dir) {
+			// A job is still using this worktree, however old its
+			// top-level mtime looks: a long timeout.post:/timeout.teardown:
+			// stage can run well past maxAge without writing anything
+			// os.ReadDir's ModTime would see.
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || time.Since(info.ModTime()) < maxAge {
+			continue
+		}
+		if err := c.Remove(ctx, os.Stderr, dir); err != nil {
+			fmt.Fprintln(os.Stderr, "repo cache gc: remove", dir, err)
+		}
+	}
+	if err := c.runLocked(ctx, os.Stderr, "git", "gc", "--auto"); err != nil {
+		fmt.Fprintln(os.Stderr, "repo cache gc:", err)
+	}
+}
@@ -0,0 +1,215 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/wepogo/testbot"
+)
+
+// Named Testfile stages, in the order the worker runs them for a
+// single job. "setup" runs once per directory, ahead of time, across
+// the whole tree (see runSetupStages); "pre", "test", "post", and
+// "teardown" run for the job's own directory only. A bare string
+// value for a job's entry (the original Testfile format) is just
+// that job's "test" stage with no pre/post/teardown.
+//
+// testbot.ParseTestfile still returns a flat map[string]string, so
+// depends_on:, env.<stage>:, and timeout.<stage>: are plain keys on
+// that map rather than a richer parsed type — extending
+// ParseTestfile itself to a real typed schema is tracked separately
+// (it lives in the root testbot package, outside this tree).
+//
+// matrix: (expanding one Testfile entry into several jobs sharing a
+// SHA, e.g. to run under more than one Go version) is deliberately
+// not handled here: expansion happens before a job ever reaches a
+// worker, so it belongs to the farmer, which also lives outside this
+// tree. Nothing in this file silently drops a matrix: key — there's
+// just nothing on the worker side to wire it to yet.
+const (
+	stageSetup    = "setup"
+	stagePre      = "pre"
+	stageTest     = "test"
+	stagePost     = "post"
+	stageTeardown = "teardown"
+)
+
+// runSetupStages runs the "setup" stage for every Testfile under
+// root, ordered so that a directory named in another's depends_on:
+// entry always runs first. Directories with no depends_on keep
+// their original walk order, matching the old "no particular order"
+// behavior. Each directory's setup runs through whatever Executor its
+// own Testfile selects (see runStage), same as its test and any
+// pre/post/teardown it has, so e.g. a Rust crate's setup can ask for
+// backend: docker for the same isolation its test gets — and its own
+// timeout.setup: override governs how long it's allowed to run.
+func runSetupStages(ctx context.Context, root string, w io.Writer, jobDir string) error {
+	dirs, entriesByDir, err := orderedSetupDirs(root)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range dirs {
+		entries := entriesByDir[dir]
+		cmd := entries[stageSetup]
+		if cmd == "" {
+			continue
+		}
+		if err := runStage(ctx, dir, w, entries, stageSetup, cmd, jobDir, jobTimeout); err != nil {
+			return xerrors.Errorf("setup %s: %w", dir, err)
+		}
+	}
+	return nil
+}
+
+// orderedSetupDirs walks root for Testfiles and topologically sorts
+// their directories by depends_on:, a comma-separated list of
+// directories (relative to root) that must run first.
+func orderedSetupDirs(root string) (dirs []string, entriesByDir map[string]map[string]string, err error) {
+	entriesByDir = map[string]map[string]string{}
+	deps := map[string][]string{}
+
+	err = filepath.Walk(root, func(fullPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || info.Name() != "Testfile" {
+			return nil
+		}
+
+		f, err := os.Open(fullPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		entries, err := testbot.ParseTestfile(f)
+		if err != nil {
+			return err
+		}
+
+		dir := filepath.Dir(fullPath)
+		dirs = append(dirs, dir)
+		entriesByDir[dir] = entries
+
+		for _, dep := range strings.Split(entries["depends_on"], ",") {
+			dep = strings.TrimSpace(dep)
+			if dep == "" {
+				continue
+			}
+			deps[dir] = append(deps[dir], filepath.Join(root, filepath.FromSlash(dep)))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ordered, err := topoSort(dirs, deps)
+	return ordered, entriesByDir, err
+}
+
+func topoSort(dirs []string, deps map[string][]string) ([]string, error) {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make(map[string]int, len(dirs))
+	order := make([]string, 0, len(dirs))
+
+	var visit func(string) error
+	visit = func(dir string) error {
+		switch state[dir] {
+		case done:
+			return nil
+		case visiting:
+			return xerrors.Errorf("depends_on cycle at %s", dir)
+		}
+		state[dir] = visiting
+		for _, dep := range deps[dir] {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		state[dir] = done
+		order = append(order, dir)
+		return nil
+	}
+
+	for _, dir := range dirs {
+		if err := visit(dir); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// stageEnv parses env.<stage>: (a comma-separated list of
+// KEY=VALUE pairs) on top of base, if the Testfile sets it.
+func stageEnv(entries map[string]string, stage string, base []string) []string {
+	raw := entries["env."+stage]
+	if raw == "" {
+		return base
+	}
+	env := append([]string{}, base...)
+	for _, kv := range strings.Split(raw, ",") {
+		if kv = strings.TrimSpace(kv); kv != "" {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+// stageTimeout parses timeout.<stage>: (a time.ParseDuration
+// string), overriding def if the Testfile sets it. A missing or
+// unparseable value leaves def in place.
+func stageTimeout(entries map[string]string, stage string, def time.Duration) time.Duration {
+	raw := entries["timeout."+stage]
+	if raw == "" {
+		return def
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil {
+		return def
+	}
+	return d
+}
+
+// runStage runs a single "setup"/"pre"/"post"/"teardown"-style stage
+// synchronously, under its own timeout.<stage>: override (or def, if
+// the Testfile doesn't set one), through whatever Executor that
+// stage's own entries select — the same backend: a Testfile's test
+// gets, so setup/pre/post/teardown are sandboxed too instead of
+// always running straight on the worker host regardless of backend.
+// "test" isn't run through here at all: it's the one stage the
+// worker starts asynchronously, so startJob owns its Executor and
+// context directly.
+func runStage(ctx context.Context, dir string, w io.Writer, entries map[string]string, stage, cmd, jobDir string, def time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, stageTimeout(entries, stage, def))
+	defer cancel()
+
+	executor := selectExecutor(entries)
+	if err := executor.Prepare(ctx, dir, w); err != nil {
+		return xerrors.Errorf("prepare %s backend: %w", entries["backend"], err)
+	}
+	defer executor.Cleanup()
+
+	fmt.Fprintf(w, "cd %s\n[%s] %s\n", dir, stage, cmd)
+	proc, err := executor.Run(ctx, dir, w, cmd, stageEnv(entries, stage, executor.Env(ctx, jobDir)))
+	if err != nil {
+		return err
+	}
+	err = proc.Wait()
+	if cerr := executor.Collect(ctx, w); cerr != nil {
+		fmt.Fprintln(w, "collect:", cerr)
+	}
+	return err
+}
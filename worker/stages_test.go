@@ -0,0 +1,76 @@
+package worker
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTopoSort(t *testing.T) {
+	dirs := []string{"a", "b", "c"}
+	deps := map[string][]string{
+		"b": {"a"},
+		"c": {"b"},
+	}
+	got, err := topoSort(dirs, deps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a", "b", "c"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("topoSort(%v, %v) = %v, want %v", dirs, deps, got, want)
+	}
+}
+
+func TestTopoSortNoDeps(t *testing.T) {
+	dirs := []string{"a", "b", "c"}
+	got, err := topoSort(dirs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// With no depends_on at all, the original walk order is kept.
+	want := []string{"a", "b", "c"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("topoSort(%v, nil) = %v, want %v", dirs, got, want)
+	}
+}
+
+func TestTopoSortCycle(t *testing.T) {
+	dirs := []string{"a", "b"}
+	deps := map[string][]string{
+		"a": {"b"},
+		"b": {"a"},
+	}
+	_, err := topoSort(dirs, deps)
+	if err == nil {
+		t.Fatal("topoSort with a depends_on cycle: got nil error, want one")
+	}
+}
+
+func TestStageEnv(t *testing.T) {
+	entries := map[string]string{"env.pre": "FOO=1, BAR=2"}
+	base := []string{"BASE=0"}
+	got := stageEnv(entries, "pre", base)
+	want := []string{"BASE=0", "FOO=1", "BAR=2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("stageEnv = %v, want %v", got, want)
+	}
+
+	if got := stageEnv(entries, "post", base); !reflect.DeepEqual(got, base) {
+		t.Errorf("stageEnv with no env.post entry = %v, want unchanged base %v", got, base)
+	}
+}
+
+func TestStageTimeout(t *testing.T) {
+	entries := map[string]string{"timeout.pre": "30s"}
+	if got, want := stageTimeout(entries, "pre", time.Minute), 30*time.Second; got != want {
+		t.Errorf("stageTimeout = %v, want %v", got, want)
+	}
+	if got, want := stageTimeout(entries, "post", time.Minute), time.Minute; got != want {
+		t.Errorf("stageTimeout with no override = %v, want default %v", got, want)
+	}
+	entries["timeout.post"] = "not-a-duration"
+	if got, want := stageTimeout(entries, "post", time.Minute), time.Minute; got != want {
+		t.Errorf("stageTimeout with unparseable override = %v, want default %v", got, want)
+	}
+}